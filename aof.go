@@ -1,11 +1,15 @@
 package aof
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"os"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
@@ -18,15 +22,151 @@ const (
 	// where a chunk is added on each call to Append.
 	maxChunkSize = 1024
 
-	chunkMetadataSize = 10
+	// chunkMetadataSize is the size in bytes of everything in a chunk other
+	// than the data (magic cookie + chunk type + codec + data length +
+	// CRC32).
+	chunkMetadataSize = 12
+
+	// defaultMaxRecordSize bounds the size of a record reassembled from
+	// FIRST/MIDDLE/LAST fragments when the caller has not set
+	// Options.MaxRecordSize, so Lookup never allocates an unbounded buffer
+	// for a corrupt fragment sequence.
+	defaultMaxRecordSize = 1 << 20
+
+	// fileMagicSize is the size in bytes of the file-level magic prefixing the
+	// header, distinct from magicCookie so a corrupt header can never be
+	// mistaken for a chunk.
+	fileMagicSize = 8
+
+	// headerFixedSize is the size of the header excluding the variable length
+	// metadata blob (magic + version + flags + metadata length).
+	headerFixedSize = fileMagicSize + 1 + 1 + 2
+
+	// currentVersion is the on-disk format version written to new files and
+	// validated by Lookup and Header. It is bumped whenever a change alters
+	// how every chunk is framed, since that is not something a flag bit can
+	// gate: version 1 had no chunk type or codec byte; this build's chunk
+	// layout adds both unconditionally (chunkMetadataSize 10 -> 12), so a
+	// file written under a different version must be rejected rather than
+	// misparsed using the wrong layout.
+	currentVersion = 3
+
+	// supportedFlags is the set of header flag bits this build understands.
+	// None are defined yet -- every chunk layout change so far has applied
+	// to every chunk unconditionally rather than being an optional, per-file
+	// feature a flag could gate, so currentVersion is what actually governs
+	// compatibility. A file with any flag bit set is rejected rather than
+	// silently misread, since a flag controls how chunks are framed on
+	// disk.
+	supportedFlags = 0
 
 	perm = 0600
 )
 
+// fileMagic prefixes the header of every AOF file. Chosen with distinct
+// bytes, similar to the PNG signature, so a truncated or corrupt header is
+// unlikely to be mistaken for a valid one.
+var fileMagic = [fileMagicSize]byte{0x41, 0x4f, 0x46, 0x1a, 0x0d, 0x0a, 0x9a, 0x0a}
+
+// Chunk types identifying whether a chunk is a whole record or a fragment of
+// a record split across multiple chunks, analogous to the block types used
+// by Riegeli-style record formats.
+const (
+	// chunkTypeFull is a chunk that contains an entire record.
+	chunkTypeFull uint8 = iota
+	// chunkTypeFirst is the first fragment of a record split across
+	// multiple chunks.
+	chunkTypeFirst
+	// chunkTypeMiddle is a fragment of a record that is neither the first
+	// nor the last.
+	chunkTypeMiddle
+	// chunkTypeLast is the last fragment of a record split across multiple
+	// chunks.
+	chunkTypeLast
+	// chunkTypeMetadata marks the very first chunk of a file, when present,
+	// as carrying stream-level metadata set via Options.Metadata rather
+	// than a user record, analogous to Riegeli's RecordsMetadata chunk.
+	// AOF.Metadata reads it back and AOF.Iterator skips over it.
+	chunkTypeMetadata
+)
+
+// Codec identifies the compression algorithm applied to a chunk's data
+// before the CRC is computed, so chunks in the same file may use different
+// codecs and a reader can decompress each independently of what Options it
+// was opened with.
+type Codec uint8
+
+const (
+	// CodecNone stores the chunk data uncompressed.
+	CodecNone Codec = iota
+	// CodecZstd compresses the chunk data with zstd.
+	CodecZstd
+	// CodecS2 compresses the chunk data with S2, a Snappy-compatible codec
+	// tuned for speed over ratio.
+	CodecS2
+	// CodecGzip compresses the chunk data with gzip.
+	CodecGzip
+)
+
 var (
 	ErrChunkSizeLimitExceeded = fmt.Errorf("exceeds the maximum chunk size of %d", maxChunkSize)
+
+	// ErrRecordSizeLimitExceeded is returned by Lookup when reassembling a
+	// fragmented record would exceed Options.MaxRecordSize.
+	ErrRecordSizeLimitExceeded = fmt.Errorf("record exceeds the maximum record size")
+
+	// ErrUnsupportedVersion is returned when a file has a version or flags
+	// this build does not understand, rather than risk misinterpreting the
+	// chunk framing.
+	ErrUnsupportedVersion = fmt.Errorf("unsupported version or flags")
+
+	// ErrUnsupportedCodec is returned when a chunk's codec byte is not one
+	// this build knows how to decompress, rather than risk returning
+	// compressed bytes to the caller as though they were the record.
+	ErrUnsupportedCodec = fmt.Errorf("unsupported codec")
+
+	errBadFileMagic = fmt.Errorf("bad file magic")
 )
 
+// Options configures an AOF opened with NewAOFWithOptions.
+type Options struct {
+	// MaxRecordSize bounds the total size of a record reassembled from
+	// FIRST/MIDDLE/LAST fragments. Zero uses defaultMaxRecordSize.
+	MaxRecordSize int64
+
+	// Codec is the compression codec used to compress chunks written by
+	// Append. Zero is CodecNone. Chunks written with a different codec (eg
+	// by an earlier process with different Options) remain readable
+	// regardless of the codec configured here, since the codec travels
+	// with the chunk.
+	Codec Codec
+
+	// Metadata, if non-empty, is written as a stream-level metadata record
+	// occupying the very first chunk of a newly created file, readable
+	// back with AOF.Metadata. It is ignored when opening a file that
+	// already exists, since metadata can only be set at creation time.
+	Metadata []byte
+}
+
+// Header is the file-level header written once at the start of an AOF file.
+type Header struct {
+	// Version is the on-disk format version.
+	Version uint8
+	// Flags are reserved bits for future per-file features that do not
+	// change how every chunk is framed (and so would not need a version
+	// bump on their own). None are defined yet.
+	Flags uint8
+	// Metadata is an optional blob stored alongside the header and read
+	// back when an existing file is opened. New files are always written
+	// with an empty blob: no option sets it, and Options.Metadata is stored
+	// in the first chunk instead (see AOF.Metadata).
+	Metadata []byte
+}
+
+func (h Header) size() int64 {
+	return int64(headerFixedSize + len(h.Metadata))
+}
+
 // AOF represents an append-only file providing error protection.
 //
 // Error protection is provided though a CRC32 checksum of each chunk to detect
@@ -36,14 +176,23 @@ var (
 // contain the magic cookie). This protects against corruption of the file
 // and partial writes, where invalid entries will be skipped.
 //
+// A record larger than maxChunkSize is split across multiple chunks: a
+// chunkTypeFirst chunk, zero or more chunkTypeMiddle chunks, and a
+// chunkTypeLast chunk, each with their own magic cookie and CRC so recovery
+// after corruption works the same as for a single chunkTypeFull chunk. If a
+// chunkTypeFirst is found without a following chunkTypeLast (eg a truncated
+// tail) the partial record is discarded rather than surfaced to the caller.
+//
 // Each chunk has the format:
-//  0                   1                   2                   3
-//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//
+//	0                   1                   2                   3
+//	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//
 // +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 // |                    Magic Cookie (0x24716296)                  |
 // +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-// |         Data Length           |                               |
-// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+                               |
+// |  Chunk Type   |     Codec     |         Data Length           |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 // \                                                               \
 // /                              Data                             /
 // \                                                               \
@@ -55,44 +204,227 @@ var (
 // appended at the end.
 // Note the CRC32 is added at the end rather than in the header since it covers
 // the whole packet not just the data.
+//
+// Data is compressed with the codec named by the Codec field before the CRC
+// is computed, so corruption of the compressed bytes is detected before
+// decompression is attempted. Since Codec is per chunk, different chunks in
+// the same file may use different codecs.
+//
+// If Options.Metadata was set when the file was created, the very first
+// chunk is a chunkTypeMetadata chunk carrying that metadata rather than a
+// user record; AOF.Metadata reads it back and AOF.Iterator skips over it.
 type AOF struct {
-	rfile io.ReadSeekCloser
-	wfile io.WriteCloser
+	rfile ChunkReader
+	wfile ChunkAppender
+
+	header Header
+
+	// codec compresses chunks written by Append. Chunks are always
+	// decompressed on read using the codec recorded in the chunk itself, so
+	// this only affects newly written chunks.
+	codec Codec
+
+	// maxRecordSize bounds the total size of a record reassembled from
+	// FIRST/MIDDLE/LAST fragments, both when appending and when looking up,
+	// so a corrupt fragment sequence can never force an unbounded
+	// allocation.
+	maxRecordSize int64
+
+	// writeOffset is the logical offset (relative to the first chunk) the
+	// next Append will start writing at.
+	writeOffset int64
 }
 
-// NewAOF opens a new append-only file at the given path.
+// NewAOF opens a new append-only file at the given path, using the default
+// options.
 func NewAOF(path string) (*AOF, error) {
-	rfile, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, perm)
+	return NewAOFWithOptions(path, Options{})
+}
+
+// NewAOFWithOptions opens a new append-only file at the given path.
+//
+// If the file does not already exist, or is empty, a fresh header is
+// written. Otherwise
+// the existing header is read and validated, returning ErrUnsupportedVersion
+// if its version or flags are not understood by this build.
+func NewAOFWithOptions(path string, opts Options) (*AOF, error) {
+	rfile, wfile, err := newLocalBackend(path)
 	if err != nil {
 		return nil, err
 	}
 
-	wfile, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+	return newAOF(rfile, wfile, opts)
+}
+
+// newAOF opens an AOF from the given backend, used both by the local-file
+// constructors above and by NewAOFWithBackend, and for testing with an in
+// memory buffer.
+func newAOF(r ChunkReader, w ChunkAppender, opts Options) (*AOF, error) {
+	size, err := r.Seek(0, io.SeekEnd)
 	if err != nil {
 		return nil, err
 	}
 
-	return newAOF(rfile, wfile)
+	maxRecordSize := opts.MaxRecordSize
+	if maxRecordSize == 0 {
+		maxRecordSize = defaultMaxRecordSize
+	}
+
+	aof := &AOF{
+		rfile:         r,
+		wfile:         w,
+		codec:         opts.Codec,
+		maxRecordSize: maxRecordSize,
+	}
+
+	if size == 0 {
+		header := Header{Version: currentVersion, Flags: supportedFlags}
+		if err := writeHeader(w, header); err != nil {
+			return nil, err
+		}
+		aof.header = header
+
+		if len(opts.Metadata) > 0 {
+			if err := aof.writeChunk(chunkTypeMetadata, opts.Metadata); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		header, err := readHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		aof.header = header
+		aof.writeOffset = size - header.size()
+	}
+
+	return aof, nil
 }
 
-// newAOF opens an AOF from the given reader and writer used for testing with
-// an in memory buffer.
-func newAOF(r io.ReadSeekCloser, w io.WriteCloser) (*AOF, error) {
-	return &AOF{
-		rfile: r,
-		wfile: w,
-	}, nil
+// Header returns the file-level header parsed when the file was opened.
+func (aof *AOF) Header() Header {
+	return aof.header
 }
 
-// Append appends the given bytes to the file.
+// Metadata returns the stream-level metadata record set via Options.Metadata
+// when the file was created, or nil if the file has none.
+func (aof *AOF) Metadata() ([]byte, error) {
+	typ, b, _, err := readChunk(aof.rfile, aof.header.size(), 0)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if typ != chunkTypeMetadata {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// Append appends the given bytes to the file as a single logical record and
+// returns the offset the record starts at (suitable for a later Lookup).
+//
+// Append first tries to write the whole record as a single chunkTypeFull
+// chunk. Append has no way to know how large a chunk will be once
+// compressed, so if that fails because the compressed bytes exceed
+// maxChunkSize -- whether because the record itself is larger than
+// maxChunkSize, or because the configured Options.Codec inflates
+// incompressible data (eg random bytes, or an already-compressed payload)
+// past it -- the record is instead fragmented into a chunkTypeFirst chunk,
+// zero or more chunkTypeMiddle chunks, and a final chunkTypeLast chunk,
+// shrinking each fragment's raw size until its compressed form fits, so
+// Lookup never has to allocate more than one chunk at a time while scanning
+// for the end of a record.
+//
+// Each chunk is compressed with the configured Options.Codec before the
+// maxChunkSize check and CRC are applied, so the limit and corruption
+// detection both act on the compressed bytes.
 //
-// The length of b must be less than or equal to 1024. If the application needs
-// larger writes its up to the application to concatenate chunks. This is to
-// avoid excessive allocations/reads when the file is corrupted.
+// The length of b must be less than or equal to the configured
+// MaxRecordSize, otherwise ErrRecordSizeLimitExceeded is returned.
 //
 // If the process crashes mid append the data appended will be ignored.
-func (aof *AOF) Append(b []byte) error {
-	if len(b) > maxChunkSize {
+func (aof *AOF) Append(b []byte) (int64, error) {
+	if int64(len(b)) > aof.maxRecordSize {
+		return 0, ErrRecordSizeLimitExceeded
+	}
+
+	start := aof.writeOffset
+
+	if len(b) <= maxChunkSize {
+		err := aof.writeChunk(chunkTypeFull, b)
+		if err == nil {
+			return start, nil
+		}
+		if err != ErrChunkSizeLimitExceeded {
+			return 0, err
+		}
+		// b fits in maxChunkSize raw, but compression inflated it past that;
+		// fall through and fragment it like an oversized record.
+	}
+
+	remaining := b
+	typ := uint8(chunkTypeFirst)
+	for len(remaining) > 0 {
+		n, err := aof.writeFragment(typ, remaining)
+		if err != nil {
+			return 0, err
+		}
+		remaining = remaining[n:]
+		typ = chunkTypeMiddle
+	}
+
+	return start, nil
+}
+
+// writeFragment writes a prefix of remaining as a single chunk of the given
+// type and returns how many bytes it consumed.
+//
+// It starts by taking up to maxChunkSize raw bytes, but shrinks that as
+// needed until the compressed result fits within maxChunkSize: compression
+// adds framing overhead, so incompressible data can come out larger than it
+// went in, and a fragment sized purely off the raw maxChunkSize limit can
+// overflow once compressed.
+//
+// If the fragment consumes the rest of remaining it is written as
+// chunkTypeLast regardless of typ, since Lookup treats chunkTypeLast as
+// ending the record.
+func (aof *AOF) writeFragment(typ uint8, remaining []byte) (int, error) {
+	n := maxChunkSize
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+
+	for {
+		fragTyp := typ
+		if n == len(remaining) {
+			fragTyp = chunkTypeLast
+		}
+
+		err := aof.writeChunk(fragTyp, remaining[:n])
+		if err == nil {
+			return n, nil
+		}
+		if err != ErrChunkSizeLimitExceeded {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, ErrChunkSizeLimitExceeded
+		}
+		n /= 2
+	}
+}
+
+// writeChunk compresses b with the configured codec and appends it as a
+// single chunk of at most maxChunkSize compressed bytes with the given
+// chunk type, advancing writeOffset by the number of bytes written.
+func (aof *AOF) writeChunk(typ uint8, b []byte) error {
+	data, err := compressChunk(aof.codec, b)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxChunkSize {
 		return ErrChunkSizeLimitExceeded
 	}
 
@@ -106,13 +438,23 @@ func (aof *AOF) Append(b []byte) error {
 		return err
 	}
 
-	checksum.Write(encodeU16(uint16(len(b))))
-	if _, err := aof.wfile.Write(encodeU16(uint16(len(b)))); err != nil {
+	checksum.Write([]byte{typ})
+	if _, err := aof.wfile.Write([]byte{typ}); err != nil {
+		return err
+	}
+
+	checksum.Write([]byte{uint8(aof.codec)})
+	if _, err := aof.wfile.Write([]byte{uint8(aof.codec)}); err != nil {
 		return err
 	}
 
-	checksum.Write(b)
-	if _, err := aof.wfile.Write(b); err != nil {
+	checksum.Write(encodeU16(uint16(len(data))))
+	if _, err := aof.wfile.Write(encodeU16(uint16(len(data)))); err != nil {
+		return err
+	}
+
+	checksum.Write(data)
+	if _, err := aof.wfile.Write(data); err != nil {
 		return err
 	}
 
@@ -120,19 +462,121 @@ func (aof *AOF) Append(b []byte) error {
 		return err
 	}
 
+	aof.writeOffset += chunkMetadataSize + int64(len(data))
+
 	return nil
 }
 
-// Lookup will lookup the next chunk from offset and returns the data in this
-// chunk and the offset of the next chunk to read.
+// RecordType identifies what kind of record LookupRecord found.
+type RecordType uint8
+
+const (
+	// RecordTypeUser is a record appended via Append.
+	RecordTypeUser RecordType = iota
+	// RecordTypeMetadata is the stream-level metadata record reserved for
+	// offset 0 on a file created with Options.Metadata; see AOF.Metadata.
+	RecordTypeMetadata
+)
+
+// Lookup will lookup the next record from offset and returns the
+// reassembled record and the offset of the record that follows.
+//
+// offset is relative to the first chunk (ie offset 0 is the first chunk
+// appended), so callers do not need to know the size of the file header.
+//
+// If a chunkTypeFirst chunk is found without a following chunkTypeLast (eg
+// mid-record corruption, or a truncated tail left by a crash partway through
+// a fragmented Append), the partial record is discarded and Lookup resyncs
+// on the next chunk instead of surfacing a torn record.
+//
+// Lookup(0) on a file created with Options.Metadata returns the metadata
+// record like any other chunk, with no way to tell it apart from a user
+// record; use LookupRecord for that, or Iterator to skip it and see only
+// user records.
 func (aof *AOF) Lookup(offset int64) ([]byte, int64, error) {
+	b, _, next, err := lookupRecord(aof.rfile, aof.header.size(), aof.maxRecordSize, offset, false)
+	return b, next, err
+}
+
+// LookupRecord is Lookup, but also returns the RecordType of what was
+// found, so a caller looking up offset 0 on a file created with
+// Options.Metadata can tell the stream-level metadata record apart from an
+// ordinary user record.
+func (aof *AOF) LookupRecord(offset int64) ([]byte, RecordType, int64, error) {
+	return lookupRecord(aof.rfile, aof.header.size(), aof.maxRecordSize, offset, false)
+}
+
+// lookup implements Lookup against an arbitrary ChunkReader, so both AOF
+// (a single shared reader) and AOFReader (a pool of readers, one borrowed
+// per call) can share the same reassembly and torn-record logic.
+//
+// If skipMetadata is set, a chunkTypeMetadata chunk is skipped rather than
+// returned, for Iterator.
+func lookup(r ChunkReader, headerSize int64, maxRecordSize int64, offset int64, skipMetadata bool) ([]byte, int64, error) {
+	b, _, next, err := lookupRecord(r, headerSize, maxRecordSize, offset, skipMetadata)
+	return b, next, err
+}
+
+// lookupRecord is lookup but also returns the RecordType of the chunk the
+// record was found in, so AOF.LookupRecord can expose it.
+func lookupRecord(r ChunkReader, headerSize int64, maxRecordSize int64, offset int64, skipMetadata bool) ([]byte, RecordType, int64, error) {
+	var record []byte
+	inRecord := false
+
 	for {
-		ret, err := aof.rfile.Seek(offset, 0)
+		typ, b, next, err := readChunk(r, headerSize, offset)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, 0, err
+		}
+
+		switch typ {
+		case chunkTypeMetadata:
+			if skipMetadata {
+				offset = next
+				continue
+			}
+			return b, RecordTypeMetadata, next, nil
+		case chunkTypeFull:
+			return b, RecordTypeUser, next, nil
+		case chunkTypeFirst:
+			// Starts a new record, discarding any fragments collected for a
+			// previous, torn record.
+			record = append([]byte(nil), b...)
+			inRecord = true
+			offset = next
+		case chunkTypeMiddle, chunkTypeLast:
+			if !inRecord {
+				// Orphan fragment with no preceding FIRST chunk: skip it and
+				// keep scanning.
+				offset = next
+				continue
+			}
+
+			record = append(record, b...)
+			if int64(len(record)) > maxRecordSize {
+				return nil, 0, 0, ErrRecordSizeLimitExceeded
+			}
+			if typ == chunkTypeLast {
+				return record, RecordTypeUser, next, nil
+			}
+			offset = next
+		}
+	}
+}
+
+// readChunk finds and validates the next chunk at or after offset (relative
+// to the first chunk) in r, resyncing on the magic cookie if the file is
+// corrupt, and returns the chunk's type, data, and the offset (relative to
+// the first chunk) of the chunk that follows.
+func readChunk(r ChunkReader, headerSize int64, offset int64) (uint8, []byte, int64, error) {
+	offset += headerSize
+	for {
+		ret, err := r.Seek(offset, 0)
+		if err != nil {
+			return 0, nil, 0, err
 		}
 		if ret != offset {
-			return nil, 0, io.EOF
+			return 0, nil, 0, io.EOF
 		}
 
 		// Keep reading until the next magic cookie is found. Note this magic
@@ -142,12 +586,12 @@ func (aof *AOF) Lookup(offset int64) ([]byte, int64, error) {
 		// is from:
 		// https://github.com/FFmpeg/FFmpeg/blob/master/libavformat/oggdec.c#L331
 		sync := make([]byte, 4)
-		_, err = io.ReadFull(aof.rfile, sync)
+		_, err = io.ReadFull(r, sync)
 		if err != nil {
 			if err == io.ErrUnexpectedEOF { // TODO(AD) Refactor this into common.
-				return nil, 0, io.EOF
+				return 0, nil, 0, io.EOF
 			}
-			return nil, 0, err
+			return 0, nil, 0, err
 		}
 
 		// Keep adding one byte to the sync until is matches the expected cookie.
@@ -157,9 +601,9 @@ func (aof *AOF) Lookup(offset int64) ([]byte, int64, error) {
 				break
 			}
 
-			c, err := readU8(aof.rfile)
+			c, err := readU8(r)
 			if err != nil {
-				return nil, 0, err
+				return 0, nil, 0, err
 			}
 
 			offset += 1
@@ -172,12 +616,25 @@ func (aof *AOF) Lookup(offset int64) ([]byte, int64, error) {
 		// Note sync may be out of order from the cookie.
 		checksum.Write(encodeU32(magicCookie))
 
-		size, err := readU16(aof.rfile)
+		typ, err := readU8(r)
 		if err != nil {
-			return nil, 0, err
+			return 0, nil, 0, err
+		}
+		checksum.Write([]byte{typ})
+
+		codec, err := readU8(r)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		checksum.Write([]byte{codec})
+
+		size, err := readU16(r)
+		if err != nil {
+			return 0, nil, 0, err
 		}
 		// Check the size before allocating a buffer incase the data is corrupt
-		// causing allocation errors.
+		// causing allocation errors. This is the compressed size, which is what
+		// was checked against maxChunkSize when the chunk was written.
 		if size > maxChunkSize {
 			// Need to increase offset to avoid re-reading the same cookie again.
 			// Can ignore the bytes from the previously read cookie since all values
@@ -189,19 +646,19 @@ func (aof *AOF) Lookup(offset int64) ([]byte, int64, error) {
 		checksum.Write(encodeU16(size))
 
 		b := make([]byte, size)
-		_, err = io.ReadFull(aof.rfile, b)
+		_, err = io.ReadFull(r, b)
 		if err != nil {
 			if err == io.ErrUnexpectedEOF {
-				return nil, 0, io.EOF
+				return 0, nil, 0, io.EOF
 			}
-			return nil, 0, err
+			return 0, nil, 0, err
 		}
 
 		checksum.Write(b)
 
-		chunkChecksum, err := readU32(aof.rfile)
+		chunkChecksum, err := readU32(r)
 		if err != nil {
-			return nil, 0, err
+			return 0, nil, 0, err
 		}
 		if checksum.Sum32() != chunkChecksum {
 			// Need to increase offset to avoid re-reading the same cookie again.
@@ -211,7 +668,74 @@ func (aof *AOF) Lookup(offset int64) ([]byte, int64, error) {
 			continue
 		}
 
-		return b, offset + chunkMetadataSize + int64(len(b)), nil
+		// The CRC has now confirmed this is a genuine chunk rather than
+		// corruption, so an unrecognised codec means this build cannot read
+		// it rather than that the bytes are garbage; fail closed instead of
+		// resyncing past it.
+		next := offset + chunkMetadataSize + int64(len(b)) - headerSize
+		data, err := decompressChunk(Codec(codec), b)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+
+		return typ, data, next, nil
+	}
+}
+
+// compressChunk compresses b with the given codec.
+func compressChunk(codec Codec, b []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return b, nil
+	case CodecZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(b, nil), nil
+	case CodecS2:
+		return s2.Encode(nil, b), nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, ErrUnsupportedCodec
+	}
+}
+
+// decompressChunk decompresses b, which was compressed with the given
+// codec, returning ErrUnsupportedCodec if codec is not one this build knows
+// how to decompress.
+func decompressChunk(codec Codec, b []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return b, nil
+	case CodecZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(b, nil)
+	case CodecS2:
+		return s2.Decode(nil, b)
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, ErrUnsupportedCodec
 	}
 }
 
@@ -225,6 +749,76 @@ func (aof *AOF) Close() error {
 	return aof.wfile.Close()
 }
 
+// Sync flushes any chunks buffered by the backend. Backends that do not
+// buffer writes (eg the local file backend) treat this as an fsync. With
+// the S3 backend, Sync does not make appended chunks readable; only Close
+// does (see NewS3AOF).
+func (aof *AOF) Sync() error {
+	return aof.wfile.Sync()
+}
+
+// writeHeader writes the file-level header, prefixing the first chunk of
+// the file.
+func writeHeader(w io.Writer, h Header) error {
+	if _, err := w.Write(fileMagic[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{h.Version, h.Flags}); err != nil {
+		return err
+	}
+	if _, err := w.Write(encodeU16(uint16(len(h.Metadata)))); err != nil {
+		return err
+	}
+	if len(h.Metadata) > 0 {
+		if _, err := w.Write(h.Metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHeader reads and validates the file-level header from the start of
+// the file, returning ErrUnsupportedVersion if its version or flags are not
+// understood by this build.
+func readHeader(r io.ReadSeeker) (Header, error) {
+	if _, err := r.Seek(0, 0); err != nil {
+		return Header{}, err
+	}
+
+	magic := make([]byte, fileMagicSize)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return Header{}, err
+	}
+	if !bytes.Equal(magic, fileMagic[:]) {
+		return Header{}, errBadFileMagic
+	}
+
+	version, err := readU8(r)
+	if err != nil {
+		return Header{}, err
+	}
+	flags, err := readU8(r)
+	if err != nil {
+		return Header{}, err
+	}
+	if version != currentVersion || flags&^uint8(supportedFlags) != 0 {
+		return Header{}, ErrUnsupportedVersion
+	}
+
+	metadataLen, err := readU16(r)
+	if err != nil {
+		return Header{}, err
+	}
+	metadata := make([]byte, metadataLen)
+	if metadataLen > 0 {
+		if _, err := io.ReadFull(r, metadata); err != nil {
+			return Header{}, err
+		}
+	}
+
+	return Header{Version: version, Flags: flags, Metadata: metadata}, nil
+}
+
 func isCookie(sync []byte, sp int64) bool {
 	return sync[sp&3] == 0x24 &&
 		sync[(sp+1)&3] == 0x71 &&
@@ -0,0 +1,56 @@
+package aof
+
+import (
+	"io"
+	"os"
+)
+
+// ChunkReader provides the random-read access Lookup needs into the bytes
+// of an AOF file, regardless of where those bytes are actually stored.
+type ChunkReader interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// ChunkAppender provides the append-only write access Append needs to the
+// bytes of an AOF file, regardless of where those bytes are actually
+// stored.
+//
+// Sync flushes any writes buffered by the backend so they become visible to
+// a ChunkReader opened against the same file. Close must imply a Sync, so a
+// caller that only calls Close still observes a complete file.
+//
+// A backend may not offer this visibility on Sync: the S3 backend in this
+// package defers the flush past Sync while too little is buffered for its
+// minimum part size, and even a part it does upload only becomes readable
+// once Close completes the upload; see that backend's docs.
+type ChunkAppender interface {
+	io.Writer
+	io.Closer
+	Sync() error
+}
+
+// NewAOFWithBackend opens an AOF using the given backend in place of a local
+// file, for backends such as the S3 backend in this package, or a custom
+// ChunkReader/ChunkAppender pair (eg an in memory buffer for testing).
+func NewAOFWithBackend(r ChunkReader, w ChunkAppender, opts Options) (*AOF, error) {
+	return newAOF(r, w, opts)
+}
+
+// newLocalBackend opens the local file at path for random-read and
+// append-only write access. *os.File already satisfies both ChunkReader and
+// ChunkAppender, so no wrapping is needed.
+func newLocalBackend(path string) (ChunkReader, ChunkAppender, error) {
+	rfile, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, perm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wfile, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rfile, wfile, nil
+}
@@ -0,0 +1,56 @@
+package aof
+
+// Iterator provides forward iteration over the user records in an AOF,
+// transparently skipping the stream-level metadata chunk reserved for
+// offset 0 (see AOF.Metadata) so callers only ever see the records they
+// appended themselves.
+//
+// It caches the offset of the next record internally, so callers do not
+// need to thread the offset returned by one Lookup into the next the way
+// they would chaining Lookup calls by hand.
+type Iterator struct {
+	aof    *AOF
+	offset int64
+	err    error
+}
+
+// Iterator returns a forward iterator starting at the first user record.
+func (aof *AOF) Iterator() *Iterator {
+	it := &Iterator{aof: aof}
+	// Start past the metadata chunk, if any, so Offset names the first user
+	// record rather than a chunk Next would skip.
+	typ, _, next, err := readChunk(aof.rfile, aof.header.size(), 0)
+	if err == nil && typ == chunkTypeMetadata {
+		it.offset = next
+	}
+	return it
+}
+
+// Next returns the next record, or the error Lookup would have returned in
+// its place (eg io.EOF once every record has been consumed). Once Next
+// returns an error, every subsequent call returns the same error.
+func (it *Iterator) Next() ([]byte, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+
+	b, next, err := lookup(it.aof.rfile, it.aof.header.size(), it.aof.maxRecordSize, it.offset, true)
+	if err != nil {
+		it.err = err
+		return nil, err
+	}
+	it.offset = next
+	return b, nil
+}
+
+// Offset returns the offset of the record the next call to Next will
+// return, suitable for a later Lookup.
+func (it *Iterator) Offset() int64 {
+	return it.offset
+}
+
+// Err returns the error returned by the most recent call to Next, or nil if
+// Next has not returned an error yet.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,153 @@
+package aof
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAOFMetadata(t *testing.T) {
+	tmp, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof, err := NewAOFWithOptions(tmp.Name(), Options{Metadata: []byte("v1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := aof.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("v1"), m) {
+		t.Errorf("%v != %v", m, []byte("v1"))
+	}
+}
+
+func TestAOFMetadataNotSet(t *testing.T) {
+	aof, _ := tempAOF(t)
+
+	m, err := aof.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != nil {
+		t.Errorf("%v != nil", m)
+	}
+}
+
+func TestAOFMetadataLookupReturnsMetadataChunk(t *testing.T) {
+	tmp, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof, err := NewAOFWithOptions(tmp.Name(), Options{Metadata: []byte("v1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := aof.Append([]byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, typ, _, err := aof.LookupRecord(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("v1"), b) {
+		t.Errorf("%v != %v", b, []byte("v1"))
+	}
+	if typ != RecordTypeMetadata {
+		t.Errorf("%v != %v", typ, RecordTypeMetadata)
+	}
+}
+
+func TestLookupRecordReturnsRecordTypeUser(t *testing.T) {
+	aof, _ := tempAOF(t)
+
+	off, err := aof.Append([]byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, typ, _, err := aof.LookupRecord(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("abcd"), b) {
+		t.Errorf("%v != %v", b, []byte("abcd"))
+	}
+	if typ != RecordTypeUser {
+		t.Errorf("%v != %v", typ, RecordTypeUser)
+	}
+}
+
+func TestIteratorSkipsMetadata(t *testing.T) {
+	tmp, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof, err := NewAOFWithOptions(tmp.Name(), Options{Metadata: []byte("v1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := aof.Append([]byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aof.Append([]byte("efgh")); err != nil {
+		t.Fatal(err)
+	}
+
+	it := aof.Iterator()
+
+	b, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("abcd"), b) {
+		t.Errorf("%v != %v", b, []byte("abcd"))
+	}
+
+	b, err = it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("efgh"), b) {
+		t.Errorf("%v != %v", b, []byte("efgh"))
+	}
+
+	if _, err := it.Next(); err != io.EOF {
+		t.Errorf("%v != %v", err, io.EOF)
+	}
+	if it.Err() != io.EOF {
+		t.Errorf("%v != %v", it.Err(), io.EOF)
+	}
+}
+
+func TestIteratorOffsetTracksNext(t *testing.T) {
+	aof, _ := tempAOF(t)
+
+	off1, err := aof.Append([]byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	off2, err := aof.Append([]byte("efgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it := aof.Iterator()
+	if it.Offset() != off1 {
+		t.Errorf("%v != %v", it.Offset(), off1)
+	}
+
+	if _, err := it.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if it.Offset() != off2 {
+		t.Errorf("%v != %v", it.Offset(), off2)
+	}
+}
@@ -0,0 +1,152 @@
+package aof
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// ErrReaderClosed is returned by AOFReader.Lookup once the reader has been
+// closed.
+var ErrReaderClosed = errors.New("aof: reader closed")
+
+// ReaderOptions configures an AOFReader opened with NewAOFReaderWithOptions.
+type ReaderOptions struct {
+	// MaxRecordSize bounds the total size of a record reassembled from
+	// FIRST/MIDDLE/LAST fragments. Zero uses defaultMaxRecordSize.
+	MaxRecordSize int64
+}
+
+// AOFReader provides read-only, concurrency-safe access to an AOF file,
+// independent of the AOF used to append to it.
+//
+// AOF.Lookup reads through a single shared ChunkReader, so calling it from
+// multiple goroutines races on that reader's seek position. AOFReader
+// instead pools ChunkReaders opened against the same file and dedicates one
+// to each Lookup call for its duration, the same per-goroutine-fd pattern
+// goleveldb uses to let reads scale with cores while writes stay serialized
+// on the single writer.
+type AOFReader struct {
+	open          func() (ChunkReader, error)
+	header        Header
+	maxRecordSize int64
+
+	// mu guards closed and idle together, so a getReader/putReader can never
+	// straddle a concurrent Close: either it observes closed before Close
+	// sets it, and Close's drain picks up whatever it just did to idle, or
+	// it observes closed already set and deals with its ChunkReader itself.
+	// A sync.Pool cannot give that guarantee, since there is no way to
+	// atomically pair a Get/Put against it with a check of a separate flag.
+	mu     sync.Mutex
+	closed bool
+	idle   []ChunkReader
+}
+
+// NewAOFReader opens an AOFReader against the local file at path, using the
+// default options.
+func NewAOFReader(path string) (*AOFReader, error) {
+	return NewAOFReaderWithOptions(path, ReaderOptions{})
+}
+
+// NewAOFReaderWithOptions opens an AOFReader against the local file at
+// path.
+func NewAOFReaderWithOptions(path string, opts ReaderOptions) (*AOFReader, error) {
+	return NewAOFReaderWithBackend(func() (ChunkReader, error) {
+		return os.OpenFile(path, os.O_RDONLY, perm)
+	}, opts)
+}
+
+// NewAOFReaderWithBackend opens an AOFReader using open to create each
+// pooled ChunkReader, for backends such as the S3 backend in this package.
+// open must return independent readers that all observe the same
+// underlying file, since Lookup calls may use several concurrently.
+func NewAOFReaderWithBackend(open func() (ChunkReader, error), opts ReaderOptions) (*AOFReader, error) {
+	r, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	header, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRecordSize := opts.MaxRecordSize
+	if maxRecordSize == 0 {
+		maxRecordSize = defaultMaxRecordSize
+	}
+
+	return &AOFReader{
+		open:          open,
+		header:        header,
+		maxRecordSize: maxRecordSize,
+	}, nil
+}
+
+// Header returns the file-level header parsed when the reader was opened.
+func (ar *AOFReader) Header() Header {
+	return ar.header
+}
+
+// Lookup looks up the next record from offset and returns the reassembled
+// record and the offset of the record that follows, the same as
+// AOF.Lookup. It is safe to call concurrently from multiple goroutines.
+func (ar *AOFReader) Lookup(offset int64) ([]byte, int64, error) {
+	r, err := ar.getReader()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer ar.putReader(r)
+
+	return lookup(r, ar.header.size(), ar.maxRecordSize, offset, false)
+}
+
+func (ar *AOFReader) getReader() (ChunkReader, error) {
+	ar.mu.Lock()
+	if ar.closed {
+		ar.mu.Unlock()
+		return nil, ErrReaderClosed
+	}
+	if n := len(ar.idle); n > 0 {
+		r := ar.idle[n-1]
+		ar.idle = ar.idle[:n-1]
+		ar.mu.Unlock()
+		return r, nil
+	}
+	ar.mu.Unlock()
+
+	return ar.open()
+}
+
+func (ar *AOFReader) putReader(r ChunkReader) {
+	ar.mu.Lock()
+	if ar.closed {
+		ar.mu.Unlock()
+		r.Close()
+		return
+	}
+	ar.idle = append(ar.idle, r)
+	ar.mu.Unlock()
+}
+
+// Close marks the AOFReader closed and closes every idle ChunkReader.
+// Readers borrowed by an in-flight Lookup are closed when they are returned
+// rather than kept idle. Once Close returns, every subsequent Lookup fails
+// with ErrReaderClosed instead of silently opening a new, never-closed
+// ChunkReader.
+func (ar *AOFReader) Close() error {
+	ar.mu.Lock()
+	ar.closed = true
+	idle := ar.idle
+	ar.idle = nil
+	ar.mu.Unlock()
+
+	var err error
+	for _, r := range idle {
+		if cerr := r.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package aof
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestAOFReaderLookup(t *testing.T) {
+	aof, path := tempAOF(t)
+
+	var offsets []int64
+	var records [][]byte
+	for i := 0; i < 10; i++ {
+		record := []byte(fmt.Sprintf("record-%d", i))
+		off, err := aof.Append(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+		records = append(records, record)
+	}
+
+	r, err := NewAOFReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i, off := range offsets {
+		b, _, err := r.Lookup(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(records[i], b) {
+			t.Errorf("%v != %v", b, records[i])
+		}
+	}
+}
+
+func TestAOFReaderLookupAfterCloseFails(t *testing.T) {
+	aof, path := tempAOF(t)
+
+	off, err := aof.Append([]byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewAOFReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := r.Lookup(off); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := r.Lookup(off); err != ErrReaderClosed {
+		t.Errorf("%v != %v", err, ErrReaderClosed)
+	}
+}
+
+// TestAOFReaderCloseConcurrentWithLookup runs Lookup and Close concurrently
+// so a race detector run exercises the window where a Lookup borrows a
+// ChunkReader just as Close marks the reader closed, guarding against a
+// ChunkReader being returned to the idle list after Close has already
+// drained it.
+func TestAOFReaderCloseConcurrentWithLookup(t *testing.T) {
+	aof, path := tempAOF(t)
+
+	off, err := aof.Append([]byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewAOFReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				_, _, err := r.Lookup(off)
+				if err == ErrReaderClosed {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestAOFReaderLookupConcurrent(t *testing.T) {
+	aof, path := tempAOF(t)
+
+	const goroutines = 8
+	const recordsPerGoroutine = 50
+
+	offsets := make([][]int64, goroutines)
+	for g := 0; g < goroutines; g++ {
+		offsets[g] = make([]int64, recordsPerGoroutine)
+		for i := 0; i < recordsPerGoroutine; i++ {
+			off, err := aof.Append([]byte(fmt.Sprintf("g%d-record-%d", g, i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			offsets[g][i] = off
+		}
+	}
+
+	r, err := NewAOFReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		g := g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < recordsPerGoroutine; i++ {
+				b, _, err := r.Lookup(offsets[g][i])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				want := []byte(fmt.Sprintf("g%d-record-%d", g, i))
+				if !reflect.DeepEqual(want, b) {
+					t.Errorf("%v != %v", b, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// benchmarkAOFReaderLookupConcurrent runs goroutines concurrent goroutines,
+// each repeatedly looking up its own disjoint range of offsets, the same
+// pattern goleveldb's BenchmarkDBReadConcurrent uses to show reads scale
+// with cores.
+func benchmarkAOFReaderLookupConcurrent(b *testing.B, goroutines int) {
+	tmp, err := os.CreateTemp("", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	aof, err := NewAOF(tmp.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	const recordsPerGoroutine = 100
+	offsets := make([][]int64, goroutines)
+	for g := 0; g < goroutines; g++ {
+		offsets[g] = make([]int64, recordsPerGoroutine)
+		for i := 0; i < recordsPerGoroutine; i++ {
+			off, err := aof.Append([]byte(fmt.Sprintf("g%d-record-%d", g, i)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			offsets[g][i] = off
+		}
+	}
+
+	r, err := NewAOFReader(tmp.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		g := g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < b.N; i++ {
+				off := offsets[g][i%recordsPerGoroutine]
+				if _, _, err := r.Lookup(off); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkAOFReaderLookupConcurrent1(b *testing.B) {
+	benchmarkAOFReaderLookupConcurrent(b, 1)
+}
+
+func BenchmarkAOFReaderLookupConcurrent4(b *testing.B) {
+	benchmarkAOFReaderLookupConcurrent(b, 4)
+}
+
+func BenchmarkAOFReaderLookupConcurrent16(b *testing.B) {
+	benchmarkAOFReaderLookupConcurrent(b, 16)
+}
@@ -0,0 +1,359 @@
+package aof
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3ReadAheadSize bounds how many bytes an s3Reader fetches in one ranged
+// GET, sized to comfortably cover a chunk header plus its largest possible
+// payload and CRC so a normal Lookup only needs one round trip, and a
+// corruption resync (which reads one byte at a time) does not issue a
+// request per byte.
+const s3ReadAheadSize = chunkMetadataSize + maxChunkSize
+
+// s3MinPartSize is the smallest size S3 allows for a multipart upload part
+// other than the last. UploadPart and UploadPartCopy calls both need it, so
+// the appender buffers writes (and any existing object content it is
+// carrying forward) until there is enough to satisfy it.
+const s3MinPartSize = 5 * 1024 * 1024
+
+// s3API is the subset of *s3.Client the S3 backend needs, as an interface so
+// tests can substitute a fake rather than talking to real S3. *s3.Client
+// satisfies it with no changes.
+type s3API interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+}
+
+// S3Config identifies the S3 (or S3-compatible) object an AOF is stored in.
+type S3Config struct {
+	// Client is the S3 client used for all requests. *s3.Client satisfies
+	// this.
+	Client s3API
+	// Bucket is the bucket the object lives in.
+	Bucket string
+	// Key is the object key.
+	Key string
+}
+
+// NewS3AOF opens an AOF backed by an S3 object rather than a local file.
+//
+// Append is implemented with a multipart upload: writes are buffered in
+// memory, and Sync uploads them as a new part of that upload once enough
+// has accumulated to satisfy S3's 5MB minimum part size (s3MinPartSize);
+// otherwise it leaves them buffered for a later Sync or Close to pick up.
+// Uploading a part does not make it readable, though: S3 only assembles a
+// multipart upload's parts into the object a GetObject sees once the
+// upload is completed. So unlike the local file backend, Sync here does
+// not make appended data visible to a Lookup against this same AOF, or any
+// other reader of the object -- only Close does, by completing the upload.
+// A long-lived appender that needs its writes visible before it is done
+// must periodically Close and reopen with NewS3AOF.
+//
+// Reopening is what carries forward whatever was written before: if the
+// existing object is already at least s3MinPartSize, it is brought into
+// the new upload with a single UploadPartCopy (S3 copies the bytes
+// server-side, so this costs a request, not a transfer); otherwise it is
+// small enough to just be read back and folded into the write buffer like
+// any other pending write.
+//
+// Lookup is implemented with ranged GETs sized to cover a chunk header and
+// its payload and CRC in a single request.
+func NewS3AOF(ctx context.Context, cfg S3Config, opts Options) (*AOF, error) {
+	size, err := s3ObjectSize(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newS3Appender(ctx, cfg, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAOF(newS3Reader(ctx, cfg, size), w, opts)
+}
+
+// s3ObjectSize returns the current size of the S3 object, or 0 if it does
+// not exist yet.
+func s3ObjectSize(ctx context.Context, cfg S3Config) (int64, error) {
+	head, err := cfg.Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(cfg.Bucket),
+		Key:    aws.String(cfg.Key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return aws.ToInt64(head.ContentLength), nil
+}
+
+// s3Reader is a ChunkReader backed by ranged GETs against an S3 object.
+type s3Reader struct {
+	ctx    context.Context
+	client s3API
+	bucket string
+	key    string
+
+	pos  int64
+	size int64
+
+	// buf and bufStart cache the most recent ranged GET, so the many small
+	// reads readChunk issues for a single chunk (and the one byte at a time
+	// reads it issues while resyncing after corruption) usually come from
+	// memory rather than a new request.
+	buf      []byte
+	bufStart int64
+}
+
+func newS3Reader(ctx context.Context, cfg S3Config, size int64) *s3Reader {
+	return &s3Reader{
+		ctx:    ctx,
+		client: cfg.Client,
+		bucket: cfg.Bucket,
+		key:    cfg.Key,
+		size:   size,
+	}
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.pos < r.bufStart || r.pos >= r.bufStart+int64(len(r.buf)) {
+		if err := r.fill(r.pos); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf[r.pos-r.bufStart:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// fill issues a single ranged GET covering [from, from+s3ReadAheadSize) and
+// caches the result.
+func (r *s3Reader) fill(from int64) error {
+	to := from + s3ReadAheadSize - 1
+	if to >= r.size {
+		to = r.size - 1
+	}
+
+	out, err := r.client.GetObject(r.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", from, to)),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	buf, err := io.ReadAll(out.Body)
+	if err != nil {
+		return err
+	}
+
+	r.buf = buf
+	r.bufStart = from
+	return nil
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		r.pos = offset
+	case io.SeekCurrent:
+		r.pos += offset
+	case io.SeekEnd:
+		r.pos = r.size + offset
+	default:
+		return 0, fmt.Errorf("aof: unsupported whence %d", whence)
+	}
+	return r.pos, nil
+}
+
+func (r *s3Reader) Close() error {
+	return nil
+}
+
+// s3Appender is a ChunkAppender backed by an S3 multipart upload. Writes
+// accumulate in buf until there is enough to satisfy s3MinPartSize, at
+// which point Sync uploads it as a new part; Close uploads whatever remains
+// regardless of size, since the last part of a multipart upload is exempt
+// from the minimum.
+type s3Appender struct {
+	ctx    context.Context
+	client s3API
+	bucket string
+	key    string
+
+	uploadID string
+	partNum  int32
+	parts    []types.CompletedPart
+
+	buf bytes.Buffer
+}
+
+func newS3Appender(ctx context.Context, cfg S3Config, existingSize int64) (*s3Appender, error) {
+	out, err := cfg.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(cfg.Bucket),
+		Key:    aws.String(cfg.Key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a := &s3Appender{
+		ctx:      ctx,
+		client:   cfg.Client,
+		bucket:   cfg.Bucket,
+		key:      cfg.Key,
+		uploadID: aws.ToString(out.UploadId),
+	}
+
+	if existingSize >= s3MinPartSize {
+		// Large enough to be its own part under the same minimum Sync
+		// enforces for new writes: copy it server-side rather than
+		// round-tripping potentially many MB of already-durable data
+		// through this process.
+		if err := a.copyExisting(); err != nil {
+			return nil, err
+		}
+	} else if existingSize > 0 {
+		// Too small to be a part on its own (a multipart upload's parts
+		// must all meet s3MinPartSize except the last), so fold it into
+		// the write buffer instead, where it is carried forward as
+		// ordinary buffered data subject to the same flushing as
+		// everything Write appends.
+		existing, err := getObject(ctx, cfg.Client, cfg.Bucket, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		a.buf.Write(existing)
+	}
+
+	return a, nil
+}
+
+// copyExisting carries the object's current contents into the new upload
+// as a part copied server-side, for when the object already meets
+// s3MinPartSize.
+func (a *s3Appender) copyExisting() error {
+	a.partNum++
+	out, err := a.client.UploadPartCopy(a.ctx, &s3.UploadPartCopyInput{
+		Bucket:     aws.String(a.bucket),
+		Key:        aws.String(a.key),
+		UploadId:   aws.String(a.uploadID),
+		PartNumber: aws.Int32(a.partNum),
+		CopySource: aws.String(a.bucket + "/" + a.key),
+	})
+	if err != nil {
+		return err
+	}
+
+	a.parts = append(a.parts, types.CompletedPart{
+		ETag:       out.CopyPartResult.ETag,
+		PartNumber: aws.Int32(a.partNum),
+	})
+	return nil
+}
+
+// getObject fetches the whole contents of an S3 object.
+func getObject(ctx context.Context, client s3API, bucket, key string) ([]byte, error) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	return io.ReadAll(out.Body)
+}
+
+func (a *s3Appender) Write(b []byte) (int, error) {
+	return a.buf.Write(b)
+}
+
+// Sync uploads the buffered bytes as a new part of the multipart upload if
+// there are enough of them to satisfy s3MinPartSize, the same minimum S3
+// enforces for every part but the last. If not, the bytes stay buffered for
+// a later Write, Sync, or Close to pick up, since uploading a short part
+// now would only make CompleteMultipartUpload fail once a further part
+// follows it.
+//
+// Unlike ChunkAppender's general contract, this does not make the data
+// visible to a ChunkReader: S3 only assembles a multipart upload's parts
+// into the object a GetObject sees once the upload is completed, which only
+// Close does. See NewS3AOF.
+func (a *s3Appender) Sync() error {
+	return a.flush(false)
+}
+
+// flush uploads the buffered bytes as a new part. If final is set the part
+// is uploaded regardless of size, since it is the last part of the upload
+// and so exempt from s3MinPartSize; otherwise the upload is skipped unless
+// the buffer already meets it.
+func (a *s3Appender) flush(final bool) error {
+	if a.buf.Len() == 0 {
+		return nil
+	}
+	if !final && a.buf.Len() < s3MinPartSize {
+		return nil
+	}
+
+	a.partNum++
+	out, err := a.client.UploadPart(a.ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(a.bucket),
+		Key:        aws.String(a.key),
+		UploadId:   aws.String(a.uploadID),
+		PartNumber: aws.Int32(a.partNum),
+		Body:       bytes.NewReader(a.buf.Bytes()),
+	})
+	if err != nil {
+		return err
+	}
+
+	a.parts = append(a.parts, types.CompletedPart{
+		ETag:       out.ETag,
+		PartNumber: aws.Int32(a.partNum),
+	})
+	a.buf.Reset()
+	return nil
+}
+
+// Close flushes any buffered bytes, however small, and completes the
+// multipart upload, making the appended chunks readable as a single S3
+// object.
+func (a *s3Appender) Close() error {
+	if err := a.flush(true); err != nil {
+		return err
+	}
+
+	_, err := a.client.CompleteMultipartUpload(a.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(a.bucket),
+		Key:      aws.String(a.key),
+		UploadId: aws.String(a.uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: a.parts,
+		},
+	})
+	return err
+}
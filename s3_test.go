@@ -0,0 +1,377 @@
+package aof
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3 is a minimal in-memory s3API, enough to exercise the S3 backend
+// without a real endpoint. It enforces the same rule real S3 does at
+// CompleteMultipartUpload: every part but the last must be at least
+// s3MinPartSize, so a backend bug that uploads short parts fails the test
+// the same way it would fail against S3.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]*fakeUpload
+	nextID  int
+}
+
+type fakeUpload struct {
+	bucket, key string
+	parts       map[int32][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]*fakeUpload),
+	}
+}
+
+func (f *fakeS3) objectKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, in *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.objects[f.objectKey(aws.ToString(in.Bucket), aws.ToString(in.Key))]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(b)))}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.objects[f.objectKey(aws.ToString(in.Bucket), aws.ToString(in.Key))]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = &fakeUpload{
+		bucket: aws.ToString(in.Bucket),
+		key:    aws.ToString(in.Key),
+		parts:  make(map[int32][]byte),
+	}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, in *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	body, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	up, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, fmt.Errorf("fakeS3: unknown upload %s", aws.ToString(in.UploadId))
+	}
+	up.parts[aws.ToInt32(in.PartNumber)] = body
+
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", aws.ToInt32(in.PartNumber)))}, nil
+}
+
+func (f *fakeS3) UploadPartCopy(ctx context.Context, in *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, ok := f.objects[aws.ToString(in.CopySource)]
+	if !ok {
+		return nil, fmt.Errorf("fakeS3: unknown copy source %s", aws.ToString(in.CopySource))
+	}
+
+	up, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, fmt.Errorf("fakeS3: unknown upload %s", aws.ToString(in.UploadId))
+	}
+	up.parts[aws.ToInt32(in.PartNumber)] = body
+
+	etag := fmt.Sprintf("etag-copy-%d", aws.ToInt32(in.PartNumber))
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: aws.String(etag)}}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	up, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, fmt.Errorf("fakeS3: unknown upload %s", aws.ToString(in.UploadId))
+	}
+
+	parts := in.MultipartUpload.Parts
+	var data []byte
+	for i, p := range parts {
+		body, ok := up.parts[aws.ToInt32(p.PartNumber)]
+		if !ok {
+			return nil, fmt.Errorf("fakeS3: unknown part %d", aws.ToInt32(p.PartNumber))
+		}
+		if i != len(parts)-1 && len(body) < s3MinPartSize {
+			return nil, fmt.Errorf("fakeS3: EntityTooSmall: part %d is %d bytes, less than the %d minimum", aws.ToInt32(p.PartNumber), len(body), s3MinPartSize)
+		}
+		data = append(data, body...)
+	}
+
+	f.objects[f.objectKey(up.bucket, up.key)] = data
+	delete(f.uploads, aws.ToString(in.UploadId))
+
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func TestS3AppendThenLookup(t *testing.T) {
+	ctx := context.Background()
+	cfg := S3Config{Client: newFakeS3(), Bucket: "b", Key: "k"}
+
+	aof, err := NewS3AOF(ctx, cfg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	off, err := aof.Append([]byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewS3AOF(ctx, cfg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _, err := reopened.Lookup(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("abcd"), b) {
+		t.Errorf("%v != %v", b, []byte("abcd"))
+	}
+}
+
+// TestS3AppendManySyncsBelowMinPartSize calls Sync after every Append, as a
+// caller following the generic ChunkAppender docs literally might. Each
+// buffered chunk is far below s3MinPartSize, so a backend that uploaded a
+// part on every Sync would fail CompleteMultipartUpload; the buffering
+// fixed here must defer all of them to Close instead.
+func TestS3AppendManySyncsBelowMinPartSize(t *testing.T) {
+	ctx := context.Background()
+	cfg := S3Config{Client: newFakeS3(), Bucket: "b", Key: "k"}
+
+	aof, err := NewS3AOF(ctx, cfg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offsets []int64
+	for i := 0; i < 20; i++ {
+		off, err := aof.Append([]byte(fmt.Sprintf("record-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+		if err := aof.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewS3AOF(ctx, cfg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, off := range offsets {
+		b, _, err := reopened.Lookup(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []byte(fmt.Sprintf("record-%d", i))
+		if !reflect.DeepEqual(want, b) {
+			t.Errorf("%v != %v", b, want)
+		}
+	}
+}
+
+// TestS3AppenderSyncDoesNotMakeDataVisible documents that, unlike the local
+// file backend, Sync on this backend does not make appended data visible
+// to any reader of the object: S3 only assembles a multipart upload's
+// parts into the object a GetObject sees once the upload is completed,
+// which only Close does.
+func TestS3AppenderSyncDoesNotMakeDataVisible(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3()
+	bucket, key := "b", "k"
+
+	a, err := newS3Appender(ctx, S3Config{Client: client, Bucket: bucket, Key: key}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte("x"), s3MinPartSize)
+	if _, err := a.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}); err == nil {
+		t.Error("expected GetObject to fail before Close")
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Body.Close()
+	got, err := io.ReadAll(out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(big, got) {
+		t.Errorf("got %d bytes, want %d bytes", len(got), len(big))
+	}
+}
+
+// TestS3AppendAcrossReopenLargeExisting reopens an S3 object already larger
+// than s3MinPartSize, exercising the copyExisting path that carries it
+// forward with a server-side UploadPartCopy rather than downloading and
+// re-uploading it.
+func TestS3AppendAcrossReopenLargeExisting(t *testing.T) {
+	ctx := context.Background()
+	cfg := S3Config{Client: newFakeS3(), Bucket: "b", Key: "k"}
+	opts := Options{MaxRecordSize: 2 * s3MinPartSize}
+
+	aof, err := NewS3AOF(ctx, cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("x"), s3MinPartSize+1024)
+	off1, err := aof.Append(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewS3AOF(ctx, cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off2, err := reopened.Append([]byte("efgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	final, err := NewS3AOF(ctx, cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b1, _, err := final.Lookup(off1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(big, b1) {
+		t.Errorf("got %d bytes, want %d bytes", len(b1), len(big))
+	}
+
+	b2, _, err := final.Lookup(off2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("efgh"), b2) {
+		t.Errorf("%v != %v", b2, []byte("efgh"))
+	}
+}
+
+// TestS3AppendAcrossReopen reopens the same S3 object and appends further
+// records, exercising the path that carries a small pre-existing object
+// into the new upload's write buffer rather than UploadPartCopy, which
+// would be subject to the same s3MinPartSize minimum.
+func TestS3AppendAcrossReopen(t *testing.T) {
+	ctx := context.Background()
+	cfg := S3Config{Client: newFakeS3(), Bucket: "b", Key: "k"}
+
+	aof, err := NewS3AOF(ctx, cfg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	off1, err := aof.Append([]byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewS3AOF(ctx, cfg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	off2, err := reopened.Append([]byte("efgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	final, err := NewS3AOF(ctx, cfg, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b1, _, err := final.Lookup(off1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("abcd"), b1) {
+		t.Errorf("%v != %v", b1, []byte("abcd"))
+	}
+
+	b2, _, err := final.Lookup(off2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte("efgh"), b2) {
+		t.Errorf("%v != %v", b2, []byte("efgh"))
+	}
+}